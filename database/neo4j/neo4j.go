@@ -1,15 +1,53 @@
 package neo4j
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strings"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
-	bolt "github.com/johnnadratowski/golang-neo4j-bolt-driver"
 	"github.com/mattes/migrate/database"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 )
 
+// systemDatabase is the name of the builtin Neo4j database used to
+// coordinate cluster-wide state such as the migration lock, independent
+// of whichever database a migration itself targets.
+const systemDatabase = "system"
+
+// migrationLockID is the fixed id of the singleton :MigrationLock node
+// that advisory-locks this module's migrations across processes.
+const migrationLockID = "migrate"
+
+// DefaultLockTimeout is how long Lock waits for a lock held by another
+// owner to expire before giving up.
+var DefaultLockTimeout = 15 * time.Second
+
+// DefaultLockTTL is how long an acquired lock is valid before it is
+// considered abandoned; the background refresher renews it every half TTL.
+var DefaultLockTTL = 15 * time.Second
+
+// schemeMap translates the bolt-driver-era URL schemes this module has
+// historically accepted into the scheme the official v5 driver expects.
+// neo4j:// and neo4j+s:// already mean "routing driver" to the v5 driver,
+// so they pass through unchanged.
+var schemeMap = map[string]string{
+	"bolt+routing": "neo4j",
+	"bolt+s":       "bolt+s",
+	"bolt+ssc":     "bolt+ssc",
+	"neo4j":        "neo4j",
+	"neo4j+s":      "neo4j+s",
+	"neo4j+ssc":    "neo4j+ssc",
+	"bolt":         "bolt",
+}
+
 func init() {
 	database.Register("neo4j", &Neo4j{})
 }
@@ -18,21 +56,39 @@ var DefaultMigrationsLabel = "SchemaMigration"
 
 var (
 	ErrNilConfig = fmt.Errorf("no config")
+
+	// ErrDropNotAllowed is returned by Drop when Config.AllowDrop is
+	// false, the same safety gate other drivers in this module use
+	// before running a destructive, whole-schema operation.
+	ErrDropNotAllowed = fmt.Errorf("drop is disabled; set Config.AllowDrop to enable it")
 )
 
 type Config struct {
-	MigrationsLabel string
-	UseTransactions bool
+	MigrationsLabel    string
+	Database           string
+	UseTransactions    bool
+	Region             string
+	FetchSize          int
+	ConnectionPoolSize int
+	LockTimeout        time.Duration
+	LockTTL            time.Duration
+	AllowDrop          bool
 }
 
 type Neo4j struct {
-	db       bolt.Conn
-	tx       bolt.Tx
-	isLocked bool
-	config   *Config
+	driver        neo4j.DriverWithContext
+	session       neo4j.SessionWithContext
+	lockSession   neo4j.SessionWithContext
+	tx            neo4j.ExplicitTransaction
+	isLocked      bool
+	config        *Config
+	owner         string
+	constraintSet bool
+	stopRefresh   chan struct{}
+	refreshDone   sync.WaitGroup
 }
 
-func WithInstance(instance bolt.Conn, config *Config) (database.Driver, error) {
+func WithInstance(instance neo4j.DriverWithContext, config *Config) (database.Driver, error) {
 	if instance == nil || config == nil {
 		return nil, ErrNilConfig
 	}
@@ -41,97 +97,354 @@ func WithInstance(instance bolt.Conn, config *Config) (database.Driver, error) {
 		config.MigrationsLabel = DefaultMigrationsLabel
 	}
 
+	if config.LockTimeout == 0 {
+		config.LockTimeout = DefaultLockTimeout
+	}
+
+	if config.LockTTL == 0 {
+		config.LockTTL = DefaultLockTTL
+	}
+
+	owner, err := newOwnerID()
+	if err != nil {
+		return nil, err
+	}
+
 	mx := &Neo4j{
-		db:     instance,
+		driver: instance,
 		config: config,
+		owner:  owner,
 	}
 
 	return mx, nil
 }
 
-func (m *Neo4j) Open(url string) (database.Driver, error) {
-	boltDriver := bolt.NewDriver()
-	conn, err := boltDriver.OpenNeo(url)
+// newOwnerID generates an identifier that is unique to this process, used
+// to tell this instance's lock apart from another process' lock on the
+// same :MigrationLock node.
+func newOwnerID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(buf)), nil
+}
+
+func (m *Neo4j) Open(rawURL string) (database.Driver, error) {
+	purl, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
 
-	driver, err := WithInstance(conn, &Config{})
+	auth := neo4j.NoAuth()
+	if purl.User != nil {
+		password, _ := purl.User.Password()
+		auth = neo4j.BasicAuth(purl.User.Username(), password, "")
+	}
+
+	scheme, ok := schemeMap[purl.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported neo4j scheme %q", purl.Scheme)
+	}
+
+	query := purl.Query()
+
+	config := &Config{
+		Database: query.Get("x-database"),
+		Region:   query.Get("x-region"),
+	}
+
+	if v := query.Get("x-fetch-size"); v != "" {
+		fetchSize, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("x-fetch-size must be an integer: %w", err)
+		}
+		config.FetchSize = fetchSize
+	}
+
+	if v := query.Get("x-connection-pool-size"); v != "" {
+		poolSize, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("x-connection-pool-size must be an integer: %w", err)
+		}
+		config.ConnectionPoolSize = poolSize
+	}
+
+	// The driver builds its routing context from the connection URI's own
+	// query string, so x-region is forwarded onto target as the "region"
+	// key rather than consumed client-side, letting an Aura/causal-cluster
+	// routing policy keyed on region steer requests server-side.
+	targetQuery := url.Values{}
+	if config.Region != "" {
+		targetQuery.Set("region", config.Region)
+	}
+
+	target := url.URL{Scheme: scheme, Host: purl.Host, Path: purl.Path, RawQuery: targetQuery.Encode()}
+	driver, err := neo4j.NewDriverWithContext(target.String(), auth, func(c *neo4j.Config) {
+		if config.FetchSize > 0 {
+			c.FetchSize = config.FetchSize
+		}
+		if config.ConnectionPoolSize > 0 {
+			c.MaxConnectionPoolSize = config.ConnectionPoolSize
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mDriver, err := WithInstance(driver, config)
 	if err != nil {
 		return nil, err
 	}
-	return driver, nil
+
+	return mDriver, nil
 }
 
 func (m *Neo4j) Close() error {
-	return m.db.Close()
+	if m.session != nil {
+		if err := m.session.Close(context.Background()); err != nil {
+			return err
+		}
+	}
+	return m.driver.Close(context.Background())
+}
+
+func (m *Neo4j) newSession() neo4j.SessionWithContext {
+	return m.driver.NewSession(context.Background(), neo4j.SessionConfig{
+		DatabaseName: m.config.Database,
+	})
+}
+
+// lockSessionConfig targets the system database and forces the driver to
+// route the lock coordination to the leader, which keeps the lock
+// consistent across a causal cluster regardless of which member a
+// migration's own queries end up on.
+func (m *Neo4j) lockSessionConfig() neo4j.SessionConfig {
+	return neo4j.SessionConfig{
+		DatabaseName: systemDatabase,
+		AccessMode:   neo4j.AccessModeWrite,
+	}
+}
+
+// ensureLockConstraint creates the uniqueness constraint that makes the
+// MERGE in tryAcquireLock atomic. It is called lazily on every Lock rather
+// than once up front, so any process can create it the first time it runs
+// against a fresh database; "constraint already exists" is not an error.
+func (m *Neo4j) ensureLockConstraint() error {
+	if m.constraintSet {
+		return nil
+	}
+
+	query := "CREATE CONSTRAINT IF NOT EXISTS FOR (l:MigrationLock) REQUIRE l.id IS UNIQUE"
+	if _, err := m.lockSession.Run(context.Background(), query, nil); err != nil {
+		return err
+	}
+
+	m.constraintSet = true
+	return nil
+}
+
+// tryAcquireLock attempts to create or reclaim the singleton MigrationLock
+// node, returning whether it now owns the lock.
+func (m *Neo4j) tryAcquireLock() (bool, error) {
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+
+	query := `MERGE (l:MigrationLock {id: $id})
+ON CREATE SET l.owner = $owner, l.acquiredAt = $now, l.expiresAt = $expiresAt
+ON MATCH SET l.owner = CASE WHEN l.expiresAt < $now THEN $owner ELSE l.owner END,
+             l.acquiredAt = CASE WHEN l.expiresAt < $now THEN $now ELSE l.acquiredAt END,
+             l.expiresAt = CASE WHEN l.expiresAt < $now OR l.owner = $owner THEN $expiresAt ELSE l.expiresAt END
+RETURN l.owner = $owner AS acquired`
+
+	params := map[string]interface{}{
+		"id":        migrationLockID,
+		"owner":     m.owner,
+		"now":       now,
+		"expiresAt": now + m.config.LockTTL.Milliseconds(),
+	}
+
+	result, err := m.lockSession.Run(ctx, query, params)
+	if err != nil {
+		return false, err
+	}
+
+	record, err := result.Single(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	acquired, _ := record.Get("acquired")
+	return acquired.(bool), nil
+}
+
+// refreshLock periodically renews the lock's expiresAt while a migration
+// runs, so a long migration does not lose the lock to another owner out
+// from under it. Unlock waits on refreshDone after closing stopRefresh,
+// so this goroutine is always done touching m.lockSession (which is not
+// safe for concurrent use) before Unlock closes and nils it out.
+func (m *Neo4j) refreshLock() {
+	defer m.refreshDone.Done()
+
+	ticker := time.NewTicker(m.config.LockTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopRefresh:
+			return
+		case <-ticker.C:
+			m.tryAcquireLock()
+		}
+	}
 }
 
 func (m *Neo4j) Lock() error {
 	if m.isLocked {
 		return database.ErrLocked
 	}
+
+	m.lockSession = m.driver.NewSession(context.Background(), m.lockSessionConfig())
+
+	if err := m.ensureLockConstraint(); err != nil {
+		m.lockSession.Close(context.Background())
+		m.lockSession = nil
+		return &database.Error{OrigErr: err, Err: "could not create MigrationLock constraint"}
+	}
+
+	deadline := time.Now().Add(m.config.LockTimeout)
+	for {
+		acquired, err := m.tryAcquireLock()
+		if err != nil {
+			m.lockSession.Close(context.Background())
+			m.lockSession = nil
+			return &database.Error{OrigErr: err, Err: "could not acquire migration lock"}
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			m.lockSession.Close(context.Background())
+			m.lockSession = nil
+			return database.ErrLocked
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	m.stopRefresh = make(chan struct{})
+	m.refreshDone.Add(1)
+	go m.refreshLock()
+
+	m.session = m.newSession()
+
 	if m.config.UseTransactions {
-		tx, err := m.db.Begin()
+		tx, err := m.session.BeginTransaction(context.Background())
 		if err != nil {
 			return &database.Error{OrigErr: err, Err: "transaction start failed"}
 		}
 		m.tx = tx
 	}
+
 	m.isLocked = true
 	return nil
 }
 
 func (m *Neo4j) Unlock() (err error) {
 	m.isLocked = false
+
+	if m.stopRefresh != nil {
+		close(m.stopRefresh)
+		m.stopRefresh = nil
+		m.refreshDone.Wait()
+	}
+
 	if m.tx != nil {
-		if e := m.tx.Commit(); e != nil {
-			err = &database.Error{OrigErr: err, Err: "transaction commit failed"}
+		if e := m.tx.Commit(context.Background()); e != nil {
+			err = &database.Error{OrigErr: e, Err: "transaction commit failed"}
 		}
 		m.tx = nil
 	}
+	if m.session != nil {
+		m.session.Close(context.Background())
+		m.session = nil
+	}
+
+	if m.lockSession != nil {
+		ctx := context.Background()
+		query := "MATCH (l:MigrationLock {id: $id, owner: $owner}) DELETE l"
+		params := map[string]interface{}{"id": migrationLockID, "owner": m.owner}
+		if _, e := m.lockSession.Run(ctx, query, params); e != nil && err == nil {
+			err = &database.Error{OrigErr: e, Err: "could not release migration lock"}
+		}
+		m.lockSession.Close(ctx)
+		m.lockSession = nil
+	}
+
 	return
 }
 
 func (m *Neo4j) Rollback() (err error) {
 	if m.tx != nil {
-		if e := m.tx.Rollback(); e != nil {
-			err = &database.Error{OrigErr: err, Err: "transaction rollback failed"}
+		if e := m.tx.Rollback(context.Background()); e != nil {
+			err = &database.Error{OrigErr: e, Err: "transaction rollback failed"}
 		}
 		m.tx = nil
 	}
 	return
 }
 
+// runQuery executes query with params against the current transaction if one
+// is open, or in an auto-commit session otherwise.
+func (m *Neo4j) runQuery(query string, params map[string]interface{}) error {
+	ctx := context.Background()
+
+	if m.tx != nil {
+		_, err := m.tx.Run(ctx, query, params)
+		return err
+	}
+
+	session := m.session
+	if session == nil {
+		session = m.newSession()
+		defer session.Close(ctx)
+	}
+
+	_, err := session.Run(ctx, query, params)
+	return err
+}
+
+// runCypher is runQuery's counterpart for callers that need the query
+// result back (e.g. to Collect rows), not just a pass/fail. It runs
+// against the current transaction if one is open, exactly like
+// runQuery, since a session with an explicit transaction open rejects
+// auto-commit session.Run calls.
+func (m *Neo4j) runCypher(ctx context.Context, session neo4j.SessionWithContext, query string, params map[string]interface{}) (neo4j.ResultWithContext, error) {
+	if m.tx != nil {
+		return m.tx.Run(ctx, query, params)
+	}
+
+	return session.Run(ctx, query, params)
+}
+
 func (m *Neo4j) Run(migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
-	contents := string(migr[:])
-	queries := strings.Split(contents, ";\n")
+	queries := splitStatements(string(migr))
 
 	for _, query := range queries {
-
-		if len(strings.TrimSpace(query)) == 0 {
-			continue
-		}
-
-		stmt, err := m.db.PrepareNeo(query)
-		if err != nil {
-			m.Rollback()
-			return &database.Error{OrigErr: err, Query: []byte(query)}
-		}
-		defer stmt.Close()
-
-		if _, err := stmt.ExecNeo(nil); err != nil {
+		if err := m.runQuery(query, nil); err != nil {
 			m.Rollback()
 			return &database.Error{OrigErr: err, Err: "migration failed", Query: []byte(query)}
 		}
-		// have to close statements in loop
-		stmt.Close()
 	}
 
 	return nil
@@ -139,7 +452,7 @@ func (m *Neo4j) Run(migration io.Reader) error {
 
 func (m *Neo4j) SetVersion(version int, dirty bool) error {
 
-	if err := m.Drop(); err != nil {
+	if err := m.dropMigrationNodes(); err != nil {
 		m.Rollback()
 		return &database.Error{OrigErr: err, Err: "Could not delete migration nodes"}
 	}
@@ -151,16 +464,25 @@ func (m *Neo4j) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
-func (m *Neo4j) createVersion(version int, dirty bool) error {
+// dropMigrationNodes removes the bookkeeping nodes SetVersion uses to
+// record the current version, without touching the rest of the schema.
+// This is distinct from Drop, which wipes the whole database and is
+// gated behind Config.AllowDrop.
+func (m *Neo4j) dropMigrationNodes() error {
+	query := "MATCH (m:" + m.config.MigrationsLabel + ") DELETE m"
 
-	query := "CREATE (:" + m.config.MigrationsLabel + " {version:{version}, dirty:{dirty}})"
-	stmt, err := m.db.PrepareNeo(query)
-	if err != nil {
-		m.Rollback()
+	if err := m.runQuery(query, nil); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
-	defer stmt.Close()
-	if _, err := stmt.ExecNeo(map[string]interface{}{"version": version, "dirty": dirty}); err != nil {
+
+	return nil
+}
+
+func (m *Neo4j) createVersion(version int, dirty bool) error {
+	query := "CREATE (:" + m.config.MigrationsLabel + " {version: $version, dirty: $dirty})"
+	params := map[string]interface{}{"version": version, "dirty": dirty}
+
+	if err := m.runQuery(query, params); err != nil {
 		m.Rollback()
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -169,36 +491,173 @@ func (m *Neo4j) createVersion(version int, dirty bool) error {
 }
 
 func (m *Neo4j) Version() (version int, dirty bool, err error) {
-	query := "MATCH (m:" + m.config.MigrationsLabel + ") return m.version, m.dirty ORDER BY m.version DESC LIMIT 1"
-	stmt, err := m.db.PrepareNeo(query)
+	ctx := context.Background()
+	query := "MATCH (m:" + m.config.MigrationsLabel + ") RETURN m.version, m.dirty ORDER BY m.version DESC LIMIT 1"
+
+	session := m.session
+	if session == nil {
+		session = m.newSession()
+		defer session.Close(ctx)
+	}
+
+	result, err := m.runCypher(ctx, session, query, nil)
 	if err != nil {
 		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
 	}
-	defer stmt.Close()
-	rows, err := stmt.QueryNeo(nil)
-	data, _, err := rows.NextNeo()
+
+	records, err := result.Collect(ctx)
 	if err != nil {
-		if err == io.EOF {
-			return database.NilVersion, false, nil
-		}
 		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
-	return int(data[0].(int64)), data[1].(bool), nil
+	if len(records) == 0 {
+		return database.NilVersion, false, nil
+	}
+
+	v, _ := records[0].Get("m.version")
+	d, _ := records[0].Get("m.dirty")
+
+	return int(v.(int64)), d.(bool), nil
 }
 
+// Drop wipes the target database back to empty: every constraint, every
+// index, and all nodes and relationships. It is gated behind
+// Config.AllowDrop because, unlike dropMigrationNodes, it is destructive
+// to the user's own schema and data, not just this module's bookkeeping.
+//
+// It always runs in its own auto-commit session rather than against
+// m.tx: "SHOW CONSTRAINTS"/"SHOW INDEXES" and especially the batched
+// "CALL {...} IN TRANSACTIONS" delete below cannot run inside a
+// caller-managed explicit transaction, and the batched delete only
+// bounds memory use if each batch actually commits as it goes rather
+// than piling up inside one open transaction.
 func (m *Neo4j) Drop() error {
-	// delete all migration nodes
-	query := "MATCH (m:" + m.config.MigrationsLabel + ") delete m"
-	stmt, err := m.db.PrepareNeo(query)
+	if !m.config.AllowDrop {
+		return ErrDropNotAllowed
+	}
+
+	ctx := context.Background()
+	session := m.newSession()
+	defer session.Close(ctx)
+
+	if err := m.dropConstraints(ctx, session); err != nil {
+		return &database.Error{OrigErr: err, Err: "could not drop constraints"}
+	}
+
+	if err := m.dropIndexes(ctx, session); err != nil {
+		return &database.Error{OrigErr: err, Err: "could not drop indexes"}
+	}
+
+	if err := m.dropAllData(ctx, session); err != nil {
+		return &database.Error{OrigErr: err, Err: "could not delete nodes and relationships"}
+	}
+
+	return nil
+}
+
+// dropConstraints drops every constraint in the database, reading the
+// list with the Neo4j 4.3+ SHOW CONSTRAINTS command and falling back to
+// the legacy db.constraints() procedure on older (3.x) servers.
+func (m *Neo4j) dropConstraints(ctx context.Context, session neo4j.SessionWithContext) error {
+	result, err := session.Run(ctx, "SHOW CONSTRAINTS YIELD name RETURN name", nil)
+	if err == nil {
+		records, err := result.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			name, _ := record.Get("name")
+			if _, err := session.Run(ctx, "DROP CONSTRAINT `"+name.(string)+"`", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	result, err = session.Run(ctx, "CALL db.constraints() YIELD description RETURN description", nil)
 	if err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.ExecNeo(nil)
+
+	records, err := result.Collect(ctx)
 	if err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+		return err
+	}
+
+	for _, record := range records {
+		description, _ := record.Get("description")
+		if _, err := session.Run(ctx, "DROP "+description.(string), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropIndexes drops every index in the database, reading the list with
+// the Neo4j 4.3+ SHOW INDEXES command and falling back to the legacy
+// db.indexes() procedure on older (3.x) servers.
+func (m *Neo4j) dropIndexes(ctx context.Context, session neo4j.SessionWithContext) error {
+	result, err := session.Run(ctx, "SHOW INDEXES YIELD name RETURN name", nil)
+	if err == nil {
+		records, err := result.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			name, _ := record.Get("name")
+			if _, err := session.Run(ctx, "DROP INDEX `"+name.(string)+"`", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	result, err = session.Run(ctx, "CALL db.indexes() YIELD description RETURN description", nil)
+	if err != nil {
+		return err
+	}
+
+	records, err := result.Collect(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		description, _ := record.Get("description")
+		if _, err := session.Run(ctx, "DROP "+description.(string), nil); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// dropAllData deletes every node and relationship, batching the delete
+// with Neo4j 4.4+'s CALL {} IN TRANSACTIONS so large graphs don't OOM a
+// single transaction, and falling back to a chunked loop of its own,
+// each iteration its own auto-commit statement, on older servers that
+// don't understand that syntax.
+func (m *Neo4j) dropAllData(ctx context.Context, session neo4j.SessionWithContext) error {
+	query := "MATCH (n) CALL { WITH n DETACH DELETE n } IN TRANSACTIONS OF 10000 ROWS"
+	if _, err := session.Run(ctx, query, nil); err == nil {
+		return nil
+	}
+
+	for {
+		result, err := session.Run(ctx, "MATCH (n) WITH n LIMIT 10000 DETACH DELETE n RETURN count(n) AS deleted", nil)
+		if err != nil {
+			return err
+		}
+
+		record, err := result.Single(ctx)
+		if err != nil {
+			return err
+		}
+
+		deleted, _ := record.Get("deleted")
+		if deleted.(int64) == 0 {
+			return nil
+		}
+	}
+}
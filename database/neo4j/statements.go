@@ -0,0 +1,123 @@
+package neo4j
+
+import "strings"
+
+const (
+	directiveStatementBegin = "+migrate StatementBegin"
+	directiveStatementEnd   = "+migrate StatementEnd"
+)
+
+// splitStatements tokenizes a Cypher migration file into individual
+// top-level statements terminated by ';'. Unlike a naive
+// strings.Split(contents, ";\n"), it tracks single/double/backtick
+// quoted strings (with backslash escapes), '//' line comments and
+// '/* ... */' block comments, so a ';' inside any of those does not end
+// a statement.
+//
+// A "-- +migrate StatementBegin" / "-- +migrate StatementEnd" pair (the
+// directive popularized by goose/sql-migrate, and used by other drivers
+// in this module) brackets a block that is emitted as a single
+// statement even if it contains top-level semicolons, so that e.g. an
+// apoc.periodic.iterate call can be split across several clauses
+// terminated by ';' without being torn apart.
+func splitStatements(contents string) []string {
+	var statements []string
+	var stmt strings.Builder
+
+	runes := []rune(contents)
+	n := len(runes)
+
+	var inQuote rune
+	inLineComment := false
+	inBlockComment := false
+	inStatementBlock := false
+
+	flush := func() {
+		s := strings.TrimSpace(stmt.String())
+		if len(s) > 0 {
+			statements = append(statements, s)
+		}
+		stmt.Reset()
+	}
+
+	for i := 0; i < n; i++ {
+		c := runes[i]
+		var next rune
+		if i+1 < n {
+			next = runes[i+1]
+		}
+
+		if inLineComment {
+			if c == '\n' {
+				inLineComment = false
+			}
+			continue
+		}
+
+		if inBlockComment {
+			if c == '*' && next == '/' {
+				inBlockComment = false
+				i++
+			}
+			continue
+		}
+
+		if inQuote != 0 {
+			stmt.WriteRune(c)
+			if c == '\\' && next != 0 {
+				stmt.WriteRune(next)
+				i++
+				continue
+			}
+			if c == inQuote {
+				inQuote = 0
+			}
+			continue
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			inQuote = c
+			stmt.WriteRune(c)
+			continue
+		case c == '/' && next == '/':
+			inLineComment = true
+			i++
+			continue
+		case c == '/' && next == '*':
+			inBlockComment = true
+			i++
+			continue
+		}
+
+		if c == '-' && next == '-' {
+			lineEnd := i + 2
+			for lineEnd < n && runes[lineEnd] != '\n' {
+				lineEnd++
+			}
+			directive := strings.TrimSpace(string(runes[i+2 : lineEnd]))
+			if directive == directiveStatementBegin {
+				inStatementBlock = true
+				i = lineEnd
+				continue
+			}
+			if directive == directiveStatementEnd {
+				inStatementBlock = false
+				flush()
+				i = lineEnd
+				continue
+			}
+		}
+
+		if c == ';' && !inStatementBlock {
+			flush()
+			continue
+		}
+
+		stmt.WriteRune(c)
+	}
+
+	flush()
+
+	return statements
+}
@@ -0,0 +1,89 @@
+package neo4j
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{
+			name:     "simple statements",
+			contents: "CREATE (:Foo);\nCREATE (:Bar);\n",
+			want:     []string{"CREATE (:Foo)", "CREATE (:Bar)"},
+		},
+		{
+			name:     "semicolon not followed by newline",
+			contents: "CREATE (:Foo); CREATE (:Bar);",
+			want:     []string{"CREATE (:Foo)", "CREATE (:Bar)"},
+		},
+		{
+			name:     "semicolon inside single-quoted string",
+			contents: "CREATE (:Foo {name: 'a;b'});",
+			want:     []string{"CREATE (:Foo {name: 'a;b'})"},
+		},
+		{
+			name:     "semicolon inside double-quoted string",
+			contents: `CREATE (:Foo {name: "a;b"});`,
+			want:     []string{`CREATE (:Foo {name: "a;b"})`},
+		},
+		{
+			name:     "semicolon inside backtick-quoted identifier",
+			contents: "MATCH (`a;b`:Foo) RETURN `a;b`;",
+			want:     []string{"MATCH (`a;b`:Foo) RETURN `a;b`"},
+		},
+		{
+			name:     "escaped quote inside string",
+			contents: `CREATE (:Foo {name: "a\";b"});`,
+			want:     []string{`CREATE (:Foo {name: "a\";b"})`},
+		},
+		{
+			name:     "semicolon inside line comment",
+			contents: "CREATE (:Foo) // comment ; still comment\n;",
+			want:     []string{"CREATE (:Foo)"},
+		},
+		{
+			name:     "semicolon inside block comment",
+			contents: "CREATE (:Foo) /* comment ; still comment */;",
+			want:     []string{"CREATE (:Foo)"},
+		},
+		{
+			name: "statement begin/end directive keeps semicolons together",
+			contents: "-- +migrate StatementBegin\n" +
+				"CALL apoc.periodic.iterate(\"MATCH (n) RETURN n\", \"DELETE n;\", {})\n" +
+				"-- +migrate StatementEnd\n;",
+			want: []string{
+				"CALL apoc.periodic.iterate(\"MATCH (n) RETURN n\", \"DELETE n;\", {})",
+			},
+		},
+		{
+			name: "statement after a directive block is its own statement",
+			contents: "-- +migrate StatementBegin\n" +
+				"CALL apoc.periodic.iterate(\"MATCH (n) RETURN n\", \"DELETE n;\", {})\n" +
+				"-- +migrate StatementEnd\n" +
+				"CREATE (:Foo);",
+			want: []string{
+				"CALL apoc.periodic.iterate(\"MATCH (n) RETURN n\", \"DELETE n;\", {})",
+				"CREATE (:Foo)",
+			},
+		},
+		{
+			name:     "blank and whitespace-only statements are dropped",
+			contents: "CREATE (:Foo);\n\n   \n;\nCREATE (:Bar);",
+			want:     []string{"CREATE (:Foo)", "CREATE (:Bar)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStatements(tt.contents)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}